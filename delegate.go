@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Delegate 定义了请求/响应生命周期中各阶段的扩展点，取代了原先写死在 init() 里的
+// 鉴权与日志行为。借鉴了 ouqiang/goproxy 的 Delegate 模型，便于会话选择、MITM、
+// 上游代理链等能力以"插拔"的方式组合，而不必改动核心转发逻辑。
+type Delegate interface {
+	// Connect 在收到 CONNECT 请求、鉴权之前调用
+	Connect(ctx *goproxy.ProxyCtx)
+	// Auth 对请求做鉴权判断，返回 false 时代理以 407 拒绝该请求/连接
+	Auth(ctx *goproxy.ProxyCtx) bool
+	// RateLimit 对请求做限流判断，返回 false 时代理以 429 拒绝该请求/连接；
+	// 与 Auth 分开是因为限流不是凭据错误，不应复用 407 状态码
+	RateLimit(ctx *goproxy.ProxyCtx) bool
+	// BeforeRequest 在请求被转发给目标服务器之前调用，可读取/改写 ctx.Req
+	BeforeRequest(ctx *goproxy.ProxyCtx)
+	// BeforeResponse 在响应写回客户端之前调用，可读取/改写 ctx.Resp
+	BeforeResponse(ctx *goproxy.ProxyCtx)
+	// ParentProxy 为该请求选择上游代理；返回 nil, nil 表示不指定（沿用默认上游配置或直连）
+	ParentProxy(req *http.Request) (*url.URL, error)
+	// Finish 在一次请求/连接处理完毕后调用，无论成败
+	Finish(ctx *goproxy.ProxyCtx)
+	// ErrorLog 汇报处理过程中产生的错误
+	ErrorLog(err error)
+}
+
+// logRequestBody 控制 LoggingDelegate 是否读取并打印请求体；大文件上传场景下
+// ioutil.ReadAll 可能把整个请求体载入内存，可通过 -log-body=false 关闭，由 -log-body 参数设置
+var logRequestBody = true
+
+// activeDelegate 是当前生效的 Delegate，默认仅做日志记录；buildDelegate 会在
+// 配置了 HeaderRewriteDelegate / RateLimitDelegate 时把它们一并组合进来。
+var activeDelegate Delegate = LoggingDelegate{}
+
+// buildDelegate 根据已加载的可选内置 Delegate 组装最终生效的 Delegate 链，
+// 日志记录始终排在最前，其后依次是限流、Header 改写。
+func buildDelegate() Delegate {
+	delegates := []Delegate{LoggingDelegate{}}
+
+	if rateLimitDelegate != nil {
+		delegates = append(delegates, rateLimitDelegate)
+	}
+	if headerRewriteDelegate != nil {
+		delegates = append(delegates, headerRewriteDelegate)
+	}
+
+	if len(delegates) == 1 {
+		return delegates[0]
+	}
+	return MultiDelegate{Delegates: delegates}
+}
+
+// LoggingDelegate 是默认的 Delegate 实现，行为与重构前写死在 init() 里的逻辑一致：
+// 打印 CONNECT/请求/响应日志，鉴权委托给 basicAuth。
+type LoggingDelegate struct{}
+
+func (LoggingDelegate) Connect(ctx *goproxy.ProxyCtx) {
+	if ctx.Req != nil {
+		log.Printf("[CONNECT请求] URL: %s", ctx.Req.URL.String())
+	}
+}
+
+func (LoggingDelegate) Auth(ctx *goproxy.ProxyCtx) bool {
+	return basicAuth(ctx.Req.Header.Get("Proxy-Authorization"))
+}
+
+func (LoggingDelegate) RateLimit(ctx *goproxy.ProxyCtx) bool {
+	return true
+}
+
+func (LoggingDelegate) BeforeRequest(ctx *goproxy.ProxyCtx) {
+	req := ctx.Req
+	if req.Body == nil {
+		log.Printf("[HTTP请求] URL: %s", req.URL.String())
+		log.Printf("[HTTP请求] 方法: %s", req.Method)
+		log.Printf("[HTTP请求] 请求体: 空")
+		return
+	}
+
+	if !logRequestBody {
+		log.Printf("[HTTP请求] URL: %s", req.URL.String())
+		log.Printf("[HTTP请求] 方法: %s", req.Method)
+		return
+	}
+
+	body, err := readAndPrintRequestBody(req)
+	if err != nil {
+		log.Printf("[HTTP] 读取请求体错误: %v", err)
+		return
+	}
+	req.Body = body
+}
+
+func (LoggingDelegate) BeforeResponse(ctx *goproxy.ProxyCtx) {
+	if ctx.Resp != nil {
+		log.Printf("[HTTP响应] 状态码: %d", ctx.Resp.StatusCode)
+	}
+}
+
+func (LoggingDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+func (LoggingDelegate) Finish(ctx *goproxy.ProxyCtx) {}
+
+func (LoggingDelegate) ErrorLog(err error) {
+	log.Printf("[proxy] error: %v", err)
+}
+
+// MultiDelegate 把多个 Delegate 串联成一个，按声明顺序依次调用；Auth 全部通过才算通过，
+// ParentProxy 取第一个给出非空结果的 Delegate。
+type MultiDelegate struct {
+	Delegates []Delegate
+}
+
+func (m MultiDelegate) Connect(ctx *goproxy.ProxyCtx) {
+	for _, d := range m.Delegates {
+		d.Connect(ctx)
+	}
+}
+
+func (m MultiDelegate) Auth(ctx *goproxy.ProxyCtx) bool {
+	for _, d := range m.Delegates {
+		if !d.Auth(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m MultiDelegate) RateLimit(ctx *goproxy.ProxyCtx) bool {
+	for _, d := range m.Delegates {
+		if !d.RateLimit(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m MultiDelegate) BeforeRequest(ctx *goproxy.ProxyCtx) {
+	for _, d := range m.Delegates {
+		d.BeforeRequest(ctx)
+	}
+}
+
+func (m MultiDelegate) BeforeResponse(ctx *goproxy.ProxyCtx) {
+	for _, d := range m.Delegates {
+		d.BeforeResponse(ctx)
+	}
+}
+
+func (m MultiDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	for _, d := range m.Delegates {
+		u, err := d.ParentProxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m MultiDelegate) Finish(ctx *goproxy.ProxyCtx) {
+	for _, d := range m.Delegates {
+		d.Finish(ctx)
+	}
+}
+
+func (m MultiDelegate) ErrorLog(err error) {
+	for _, d := range m.Delegates {
+		d.ErrorLog(err)
+	}
+}
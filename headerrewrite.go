@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"gopkg.in/yaml.v2"
+)
+
+// headerRewriteConfigPath 指向描述 header 改写规则的 YAML 文件，由 -header-rewrite-config 参数设置；
+// 为空则不启用 HeaderRewriteDelegate。
+var headerRewriteConfigPath string
+
+// headerRewriteDelegate 是加载成功后生效的 HeaderRewriteDelegate 实例，由 buildDelegate 接入 activeDelegate
+var headerRewriteDelegate *HeaderRewriteDelegate
+
+// headerRule 描述对匹配 HostPattern 的请求所做的 header 增改/删除。
+// HostPattern 支持精确匹配，或形如 "*.example.com" 的后缀通配。
+type headerRule struct {
+	HostPattern string            `yaml:"host_pattern"`
+	Set         map[string]string `yaml:"set"`
+	Remove      []string          `yaml:"remove"`
+}
+
+type headerRewriteConfig struct {
+	Rules []headerRule `yaml:"rules"`
+}
+
+// HeaderRewriteDelegate 按 host 模式对请求头做增删改，规则从 YAML 文件加载。
+type HeaderRewriteDelegate struct {
+	rules []headerRule
+}
+
+// loadHeaderRewriteDelegate 从 path 指向的 YAML 文件加载改写规则
+func loadHeaderRewriteDelegate(path string) (*HeaderRewriteDelegate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg headerRewriteConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	return &HeaderRewriteDelegate{rules: cfg.Rules}, nil
+}
+
+// hostMatchesPattern 判断 host 是否匹配 pattern："*"/空 匹配任意 host，
+// "*.example.com" 匹配 example.com 及其任意子域名，否则要求精确相等。
+func hostMatchesPattern(pattern, host string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		base := pattern[2:]
+		return host == base || strings.HasSuffix(host, "."+base)
+	}
+	return pattern == host
+}
+
+func (d *HeaderRewriteDelegate) Connect(ctx *goproxy.ProxyCtx) {}
+
+func (d *HeaderRewriteDelegate) Auth(ctx *goproxy.ProxyCtx) bool {
+	return true
+}
+
+func (d *HeaderRewriteDelegate) RateLimit(ctx *goproxy.ProxyCtx) bool {
+	return true
+}
+
+func (d *HeaderRewriteDelegate) BeforeRequest(ctx *goproxy.ProxyCtx) {
+	req := ctx.Req
+	host := req.URL.Hostname()
+
+	for _, rule := range d.rules {
+		if !hostMatchesPattern(rule.HostPattern, host) {
+			continue
+		}
+		for k, v := range rule.Set {
+			req.Header.Set(k, v)
+		}
+		for _, k := range rule.Remove {
+			req.Header.Del(k)
+		}
+	}
+}
+
+func (d *HeaderRewriteDelegate) BeforeResponse(ctx *goproxy.ProxyCtx) {}
+
+func (d *HeaderRewriteDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+func (d *HeaderRewriteDelegate) Finish(ctx *goproxy.ProxyCtx) {}
+
+func (d *HeaderRewriteDelegate) ErrorLog(err error) {}
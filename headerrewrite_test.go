@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestHostMatchesPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"", "anything.com", true},
+		{"*", "anything.com", true},
+		{"*.example.com", "example.com", true},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "notexample.com", false},
+		{"example.com", "example.com", true},
+		{"example.com", "api.example.com", false},
+	}
+	for _, c := range cases {
+		if got := hostMatchesPattern(c.pattern, c.host); got != c.want {
+			t.Errorf("hostMatchesPattern(%q, %q) = %v, want %v", c.pattern, c.host, got, c.want)
+		}
+	}
+}
+
+func TestHeaderRewriteDelegateBeforeRequest(t *testing.T) {
+	d := &HeaderRewriteDelegate{
+		rules: []headerRule{
+			{
+				HostPattern: "*.example.com",
+				Set:         map[string]string{"X-Rewritten": "yes"},
+				Remove:      []string{"X-Drop-Me"},
+			},
+		},
+	}
+
+	req, err := http.NewRequest("GET", "http://api.example.com/path", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Drop-Me", "secret")
+
+	ctx := &goproxy.ProxyCtx{Req: req}
+	d.BeforeRequest(ctx)
+
+	if got := req.Header.Get("X-Rewritten"); got != "yes" {
+		t.Errorf("X-Rewritten = %q, want %q", got, "yes")
+	}
+	if got := req.Header.Get("X-Drop-Me"); got != "" {
+		t.Errorf("X-Drop-Me should have been removed, got %q", got)
+	}
+}
+
+func TestHeaderRewriteDelegateSkipsNonMatchingHost(t *testing.T) {
+	d := &HeaderRewriteDelegate{
+		rules: []headerRule{
+			{HostPattern: "*.example.com", Set: map[string]string{"X-Rewritten": "yes"}},
+		},
+	}
+
+	req, err := http.NewRequest("GET", "http://other.com/path", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+
+	ctx := &goproxy.ProxyCtx{Req: req}
+	d.BeforeRequest(ctx)
+
+	if got := req.Header.Get("X-Rewritten"); got != "" {
+		t.Errorf("X-Rewritten should be unset for non-matching host, got %q", got)
+	}
+}
@@ -1,20 +1,42 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strings"
-	"bytes"
-	"io/ioutil"
 
 	"github.com/elazarl/goproxy"
 )
 
 var httpProxy = goproxy.NewProxyHttpServer()
 
+// upstreamDialer 在配置了 -upstream-proxies 时持有已解析的上游代理列表，为 nil 时直接拨号目标
+var upstreamDialer *UpstreamDialer
+
+// dialWithOutgoingIP 使用 localAddr 作为源地址连接 addr。先征询 activeDelegate.ParentProxy
+// 是否为该请求指定了专属上游，否则落回配置的 -upstream-proxies 列表，都没有则直接拨号目标服务器。
+// HTTP 明文路径、CONNECT 隧道路径与 SOCKS5 路径共用此函数，req 在 SOCKS5 场景下可为 nil。
+func dialWithOutgoingIP(localAddr *net.TCPAddr, network, addr string, req *http.Request) (net.Conn, error) {
+	if req != nil {
+		if parent, err := activeDelegate.ParentProxy(req); err != nil {
+			return nil, fmt.Errorf("parent proxy selection error: %w", err)
+		} else if parent != nil {
+			return upstreamDialerForParent(parent.String()).Dial(network, localAddr, addr)
+		}
+	}
+	if upstreamDialer.enabled() {
+		return upstreamDialer.Dial(network, localAddr, addr)
+	}
+	return (&net.Dialer{LocalAddr: localAddr}).Dial(network, addr)
+}
+
 // 验证函数
 func basicAuth(auth string) bool {
 	// 如果没有设置用户名密码，则允许所有连接
@@ -42,7 +64,7 @@ func basicAuth(auth string) bool {
 		return false
 	}
 	
-	return credentials[0] == proxyUser && credentials[1] == proxyPassword
+	return sessionBaseUsername(credentials[0]) == proxyUser && credentials[1] == proxyPassword
 }
 
 // 读取并打印请求体，同时返回一个新的请求体供后续使用
@@ -65,46 +87,69 @@ func readAndPrintRequestBody(req *http.Request) (io.ReadCloser, error) {
 	return req.Body, nil
 }
 
+// registerDelegates 按已配置的开关加载可选内置 Delegate（Header 改写、限流），
+// 随后把它们与 LoggingDelegate 一并组装成 activeDelegate。其调用时机与
+// registerMITM/startSocks5 一致：由外层 main 在解析完命令行参数后调用。
+func registerDelegates() {
+	if headerRewriteConfigPath != "" {
+		d, err := loadHeaderRewriteDelegate(headerRewriteConfigPath)
+		if err != nil {
+			log.Fatalf("[header-rewrite] 加载配置失败: %v", err)
+		}
+		headerRewriteDelegate = d
+		log.Printf("[header-rewrite] 加载了 %d 条规则", len(d.rules))
+	}
+
+	if rateLimitEnabled {
+		rateLimitDelegate = newRateLimitDelegate(rateLimitPerSecond, rateLimitBurst)
+		log.Printf("[rate-limit] 已启用，rate=%.1f/s burst=%d", rateLimitPerSecond, rateLimitBurst)
+	}
+
+	activeDelegate = buildDelegate()
+}
+
 func init() {
 	httpProxy.Verbose = true
 
 	// 添加日志验证参数
 	log.Printf("Proxy authentication configured - User: %s, Password: %s", proxyUser, proxyPassword)
 
-	// 添加认证检查
+	// 添加认证检查，鉴权逻辑交由 activeDelegate.Auth 决定
 	httpProxy.OnRequest().Do(goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		// 检查认证信息
-		if !basicAuth(req.Header.Get("Proxy-Authorization")) {
+		if !activeDelegate.Auth(ctx) {
 			// 返回 407 Proxy Authentication Required
 			return req, goproxy.NewResponse(req,
 				goproxy.ContentTypeText,
 				407,
 				"Proxy Authentication Required")
 		}
+		if !activeDelegate.RateLimit(ctx) {
+			// 限流不是凭据错误，用 429 而不是 407
+			return req, goproxy.NewResponse(req,
+				goproxy.ContentTypeText,
+				429,
+				"Too Many Requests")
+		}
 		return req, nil
 	}))
 
 	httpProxy.OnRequest().DoFunc(
 		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-			// 打印请求URL和请求体
-			if req.Body != nil {
-				var err error
-				req.Body, err = readAndPrintRequestBody(req)
-				if err != nil {
-					log.Printf("[HTTP] 读取请求体错误: %v", err)
-				}
-			} else {
-				log.Printf("[HTTP请求] URL: %s", req.URL.String())
-				log.Printf("[HTTP请求] 方法: %s", req.Method)
-				log.Printf("[HTTP请求] 请求体: 空")
-			}
-			
+			// Finish 必须在每条早退路径上都执行，与 CONNECT 隧道那边的约定保持一致
+			defer activeDelegate.Finish(ctx)
+
+			// 请求体读取/日志、Header 改写等都由 activeDelegate.BeforeRequest 完成
+			activeDelegate.BeforeRequest(ctx)
+
 			// 为 IPv6 地址添加方括号
-			outgoingIP, err := generateRandomIPv6(cidr)
+			outgoingIP, err := pickOutgoingIP(ctx, req)
 			if err != nil {
 				log.Printf("Generate random IPv6 error: %v", err)
 				return req, nil
 			}
+			if !allowOutgoingIP(outgoingIP) {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, 429, "Too Many Requests")
+			}
 			outgoingIP = "[" + outgoingIP + "]"
 			// 使用指定的出口 IP 地址创建连接
 			localAddr, err := net.ResolveTCPAddr("tcp", outgoingIP+":0")
@@ -112,10 +157,6 @@ func init() {
 				log.Printf("[http] Resolve local address error: %v", err)
 				return req, nil
 			}
-			dialer := net.Dialer{
-				LocalAddr: localAddr,
-			}
-
 			// 通过代理服务器建立到目标服务器的连接
 			// 发送 http 请求
 			// 使用自定义拨号器设置 HTTP 客户端
@@ -128,9 +169,11 @@ func init() {
 			}
 			newReq.Header = req.Header
 
-			// 修改Transport配置，添加HTTP/2支持
+			// 修改Transport配置，添加HTTP/2支持；出站经 dialWithOutgoingIP 按需走上游代理链
 			transport := &http.Transport{
-				DialContext: dialer.DialContext,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialWithOutgoingIP(localAddr, network, addr, req)
+				},
 				ForceAttemptHTTP2: true,
 			}
 
@@ -142,76 +185,92 @@ func init() {
 			// 发送 HTTP 请求
 			resp, err := client.Do(newReq)
 			if err != nil {
-				log.Printf("[http] Send request error: %v", err)
+				activeDelegate.ErrorLog(fmt.Errorf("send request error: %w", err))
 				return req, nil
 			}
-			
-			// 打印响应状态码
-			log.Printf("[HTTP响应] 状态码: %d", resp.StatusCode)
-			
+
+			// 回写响应，做响应阶段的改写/日志；Finish 由上面的 defer 统一负责
+			ctx.Resp = resp
+			activeDelegate.BeforeResponse(ctx)
+
 			return req, resp
 		},
 	)
 
-	// 修改 CONNECT 处理，添加认证
+	// 修改 CONNECT 处理：鉴权与隧道接管方式（MITM 或普通直通）必须在同一个 handler 里
+	// 一起返回。goproxy 的 CONNECT 分发按注册顺序调用 handler，在第一个返回非 nil
+	// ConnectAction 的地方就截断——先前把鉴权和 HijackConnect 分开注册会导致鉴权
+	// handler 的 OkConnect/RejectConnect 永远抢在后面的 HijackConnect 之前返回，
+	// 使隧道接管逻辑形同虚设。mitmEnabled 在这里按请求时读取，而不是在注册时分支，
+	// 这样即使它是在 main 里 flag.Parse 之后才被设置也能生效。
 	httpProxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		if !basicAuth(ctx.Req.Header.Get("Proxy-Authorization")) {
+		activeDelegate.Connect(ctx)
+		if !activeDelegate.Auth(ctx) {
 			ctx.Resp = goproxy.NewResponse(ctx.Req,
 				goproxy.ContentTypeText,
 				407,
 				"Proxy Authentication Required")
 			return goproxy.RejectConnect, host
 		}
-		return goproxy.OkConnect, host
+		if !activeDelegate.RateLimit(ctx) {
+			ctx.Resp = goproxy.NewResponse(ctx.Req,
+				goproxy.ContentTypeText,
+				429,
+				"Too Many Requests")
+			return goproxy.RejectConnect, host
+		}
+		if mitmEnabled {
+			return &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: mitmHijackConnect}, host
+		}
+		return &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: plainHijackConnect}, host
 	})
+}
 
-	httpProxy.OnRequest().HijackConnect(
-		func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
-			// 打印CONNECT请求的URL
-			log.Printf("[CONNECT请求] URL: %s", req.URL.String())
-			
-			// 通过代理服务器建立到目标服务器的连接
-			outgoingIP, err := generateRandomIPv6(cidr)
-			if err != nil {
-				log.Printf("Generate random IPv6 error: %v", err)
-				return
-			}
-			outgoingIP = "[" + outgoingIP + "]"
-			// 使用指定的出口 IP 地址创建连接
-			localAddr, err := net.ResolveTCPAddr("tcp", outgoingIP+":0")
-			if err != nil {
-				log.Printf("[http] Resolve local address error: %v", err)
-				return
-			}
-			dialer := net.Dialer{
-				LocalAddr: localAddr,
-			}
+// plainHijackConnect 在未开启 MITM 时接管 CONNECT 隧道：选取出口 IPv6、拨号目标服务器，
+// 随后在客户端与目标服务器之间直接转发字节流，出站经 dialWithOutgoingIP 按需走上游代理链。
+func plainHijackConnect(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	defer activeDelegate.Finish(ctx)
 
-			// 通过代理服务器建立到目标服务器的连接
-			server, err := dialer.Dial("tcp", req.URL.Host)
-			if err != nil {
-				log.Printf("[http] Dial to %s error: %v", req.URL.Host, err)
-				client.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
-				client.Close()
-				return
-			}
+	// 通过代理服务器建立到目标服务器的连接
+	outgoingIP, err := pickOutgoingIP(ctx, req)
+	if err != nil {
+		log.Printf("Generate random IPv6 error: %v", err)
+		return
+	}
+	if !allowOutgoingIP(outgoingIP) {
+		client.Write([]byte("HTTP/1.1 429 Too Many Requests\r\n\r\n"))
+		client.Close()
+		return
+	}
+	outgoingIP = "[" + outgoingIP + "]"
+	// 使用指定的出口 IP 地址创建连接
+	localAddr, err := net.ResolveTCPAddr("tcp", outgoingIP+":0")
+	if err != nil {
+		log.Printf("[http] Resolve local address error: %v", err)
+		return
+	}
+	// 通过代理服务器建立到目标服务器的连接，按需经由上游代理链转发
+	server, err := dialWithOutgoingIP(localAddr, "tcp", req.URL.Host, req)
+	if err != nil {
+		log.Printf("[http] Dial to %s error: %v", req.URL.Host, err)
+		client.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
+		client.Close()
+		return
+	}
 
-			// 响应客户端连接已建立
-			client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-			// 从客户端复制数据到目标服务器
-			go func() {
-				defer server.Close()
-				defer client.Close()
-				io.Copy(server, client)
-			}()
-
-			// 从目标服务器复制数据到客户端
-			go func() {
-				defer server.Close()
-				defer client.Close()
-				io.Copy(client, server)
-			}()
+	// 响应客户端连接已建立
+	client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+	// 从客户端复制数据到目标服务器
+	go func() {
+		defer server.Close()
+		defer client.Close()
+		io.Copy(server, client)
+	}()
 
-		},
-	)
+	// 从目标服务器复制数据到客户端
+	go func() {
+		defer server.Close()
+		defer client.Close()
+		io.Copy(client, server)
+	}()
 }
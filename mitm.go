@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// mitmEnabled 控制是否开启 MITM 解密模式，由 -mitm 命令行参数设置
+var mitmEnabled bool
+
+// mitmCAFile / mitmKeyFile 指定根证书及私钥的存放路径，不存在时会自动生成
+var mitmCAFile = "mitm-ca.pem"
+var mitmKeyFile = "mitm-ca-key.pem"
+
+// CertCache 是签发证书的缓存接口，避免对同一 SNI 重复签发证书
+type CertCache interface {
+	Get(host string) *tls.Certificate
+	Set(host string, cert *tls.Certificate)
+}
+
+// syncMapCertCache 是基于 sync.Map 的默认 CertCache 实现
+type syncMapCertCache struct {
+	certs sync.Map
+}
+
+func newSyncMapCertCache() *syncMapCertCache {
+	return &syncMapCertCache{}
+}
+
+func (c *syncMapCertCache) Get(host string) *tls.Certificate {
+	if v, ok := c.certs.Load(host); ok {
+		return v.(*tls.Certificate)
+	}
+	return nil
+}
+
+func (c *syncMapCertCache) Set(host string, cert *tls.Certificate) {
+	c.certs.Store(host, cert)
+}
+
+// defaultCertCache 是进程内共享的证书缓存
+var defaultCertCache CertCache = newSyncMapCertCache()
+
+// rootCA 持有加载（或生成）后的根证书及其解析后的叶子签发所需材料
+var rootCA *tls.Certificate
+var rootCAx509 *x509.Certificate
+
+// loadOrCreateRootCA 从 mitmCAFile/mitmKeyFile 加载根证书，不存在则生成并持久化
+func loadOrCreateRootCA() error {
+	certPEM, certErr := os.ReadFile(mitmCAFile)
+	keyPEM, keyErr := os.ReadFile(mitmKeyFile)
+	if certErr == nil && keyErr == nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("parse root CA error: %w", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parse root CA x509 error: %w", err)
+		}
+		cert.Leaf = leaf
+		rootCA = &cert
+		rootCAx509 = leaf
+		return nil
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate root CA key error: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "go-proxy-ipv6-pool MITM Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return fmt.Errorf("create root CA error: %w", err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	certOut, err := os.Create(mitmCAFile)
+	if err != nil {
+		return err
+	}
+	defer certOut.Close()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+		return err
+	}
+
+	keyOut, err := os.OpenFile(mitmKeyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}); err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return err
+	}
+
+	rootCA = &tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}
+	rootCAx509 = leaf
+	return nil
+}
+
+// rootCAFingerprint 返回根证书的 SHA-256 指纹，便于用户在客户端导入信任时核对
+func rootCAFingerprint() string {
+	if rootCAx509 == nil {
+		return ""
+	}
+	sum := sha256.Sum256(rootCAx509.Raw)
+	return fmt.Sprintf("%x", sum)
+}
+
+// signLeafCert 为给定 host 签发一张由 rootCA 签名的叶子证书
+func signLeafCert(host string) (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, rootCAx509, &priv.PublicKey, rootCA.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{derBytes, rootCA.Certificate[0]},
+		PrivateKey:  priv,
+	}, nil
+}
+
+// getCertForHost 从缓存中取出 host 对应的证书，不存在则签发并写入缓存
+func getCertForHost(host string) (*tls.Certificate, error) {
+	if cert := defaultCertCache.Get(host); cert != nil {
+		return cert, nil
+	}
+	cert, err := signLeafCert(host)
+	if err != nil {
+		return nil, err
+	}
+	defaultCertCache.Set(host, cert)
+	return cert, nil
+}
+
+// mitmHijackConnect 是开启 MITM 模式时使用的 CONNECT 处理函数：
+// 对客户端做 TLS 终结，逐个解码请求后经由随机 IPv6 拨号器转发给目标服务器。
+func mitmHijackConnect(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	host := req.URL.Host
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	log.Printf("[MITM] 接管 CONNECT: %s", host)
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		log.Printf("[MITM] 回复客户端 200 失败: %v", err)
+		return
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hostname
+			if hello.ServerName != "" {
+				name = hello.ServerName
+			}
+			return getCertForHost(name)
+		},
+	}
+
+	tlsClient := tls.Server(client, tlsConfig)
+	defer tlsClient.Close()
+
+	if err := tlsClient.Handshake(); err != nil {
+		log.Printf("[MITM] 与客户端握手失败: %v", err)
+		return
+	}
+
+	reader := bufio.NewReader(tlsClient)
+	for {
+		decodedReq, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[MITM] 读取解密请求失败: %v", err)
+			}
+			return
+		}
+
+		decodedReq.URL.Scheme = "https"
+		decodedReq.URL.Host = host
+		decodedReq.RequestURI = ""
+
+		if !mitmForwardDecoded(ctx, decodedReq, tlsClient) {
+			return
+		}
+	}
+}
+
+// mitmForwardDecoded 把 MITM 解密出的单个请求交给 activeDelegate 走与明文 HTTP 路径
+// （http.go 的 DoFunc）一致的生命周期：限流、BeforeRequest/BeforeResponse、Finish、
+// ErrorLog，使解密后的流量最终落入与 HTTP 代理相同的日志/限流/Header 改写逻辑，而不是
+// 像之前那样自成一套 log.Printf。返回 false 时调用方应结束该 CONNECT 隧道。
+func mitmForwardDecoded(ctx *goproxy.ProxyCtx, decodedReq *http.Request, tlsClient io.Writer) bool {
+	ctx.Req = decodedReq
+	defer activeDelegate.Finish(ctx)
+
+	if !activeDelegate.RateLimit(ctx) {
+		log.Printf("[MITM] 请求 %s 已触发限流", decodedReq.URL.String())
+		writeMITMResponse(tlsClient, decodedReq, 429, "Too Many Requests")
+		return false
+	}
+
+	activeDelegate.BeforeRequest(ctx)
+
+	outgoingIP, err := pickOutgoingIP(ctx, decodedReq)
+	if err != nil {
+		activeDelegate.ErrorLog(fmt.Errorf("[MITM] 选取出口 IPv6 失败: %w", err))
+		return false
+	}
+	if !allowOutgoingIP(outgoingIP) {
+		log.Printf("[MITM] 出口 IPv6 %s 已触发限流", outgoingIP)
+		writeMITMResponse(tlsClient, decodedReq, 429, "Too Many Requests")
+		return false
+	}
+	outgoingIP = "[" + outgoingIP + "]"
+
+	localAddr, err := net.ResolveTCPAddr("tcp", outgoingIP+":0")
+	if err != nil {
+		activeDelegate.ErrorLog(fmt.Errorf("[MITM] 解析本地地址失败: %w", err))
+		return false
+	}
+	transport := &http.Transport{
+		DialContext: func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+			return dialWithOutgoingIP(localAddr, network, addr, decodedReq)
+		},
+		ForceAttemptHTTP2: true,
+	}
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Do(decodedReq)
+	if err != nil {
+		activeDelegate.ErrorLog(fmt.Errorf("[MITM] 转发请求失败: %w", err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	ctx.Resp = resp
+	activeDelegate.BeforeResponse(ctx)
+
+	if err := resp.Write(tlsClient); err != nil {
+		activeDelegate.ErrorLog(fmt.Errorf("[MITM] 写回响应失败: %w", err))
+		return false
+	}
+
+	return decodedReq.Header.Get("Connection") != "close" && resp.Header.Get("Connection") != "close"
+}
+
+// writeMITMResponse 在限流等早退路径下，向已完成 TLS 终结的客户端连接直接写回一个文本响应
+func writeMITMResponse(w io.Writer, req *http.Request, status int, text string) {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, status, text)
+	resp.Write(w)
+}
+
+// registerMITM 在开启 -mitm 时加载/生成根 CA 并打印指纹。隧道接管本身（在
+// mitmHijackConnect 与 plainHijackConnect 之间选择）由 http.go 中合并了鉴权检查的
+// 单个 HandleConnectFunc handler 负责，不在这里注册，避免落入 goproxy 按注册顺序、
+// 首个非 nil ConnectAction 即截断分发的坑。
+func registerMITM() {
+	if !mitmEnabled {
+		return
+	}
+
+	if err := loadOrCreateRootCA(); err != nil {
+		log.Fatalf("[MITM] 加载/生成根证书失败: %v", err)
+	}
+	log.Printf("[MITM] 根证书指纹 (SHA-256): %s", rootCAFingerprint())
+}
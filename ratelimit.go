@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// rateLimitEnabled 控制是否启用 RateLimitDelegate，由 -rate-limit 参数设置
+var rateLimitEnabled bool
+
+// rateLimitPerSecond / rateLimitBurst 配置令牌桶的填充速率与容量，分别对每个出口 IPv6
+// 和每个用户生效，由 -rate-limit-rps / -rate-limit-burst 参数设置
+var rateLimitPerSecond = 5.0
+var rateLimitBurst = 20
+
+// rateLimitDelegate 是启用限流后生效的 RateLimitDelegate 实例，由 buildDelegate 接入 activeDelegate
+var rateLimitDelegate *RateLimitDelegate
+
+// tokenBucket 是一个简单的令牌桶实现，tokens 随时间按 rate 匀速补充，上限为 burst
+type tokenBucket struct {
+	mu         sync.Mutex
+	tokens     float64
+	rate       float64
+	burst      float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		tokens:     float64(burst),
+		rate:       rate,
+		burst:      float64(burst),
+		lastRefill: time.Now(),
+	}
+}
+
+// allow 尝试消费一个令牌，返回是否还有余量
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.lastRefill = now
+
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimitDelegate 对每个出口 IPv6 和每个认证用户分别维护令牌桶，防止单个用户
+// 或单个出口 IP 占满整个 IPv6 池的请求配额。
+type RateLimitDelegate struct {
+	mu      sync.Mutex
+	perUser map[string]*tokenBucket
+	perIP   map[string]*tokenBucket
+	rate    float64
+	burst   int
+}
+
+func newRateLimitDelegate(rate float64, burst int) *RateLimitDelegate {
+	return &RateLimitDelegate{
+		perUser: make(map[string]*tokenBucket),
+		perIP:   make(map[string]*tokenBucket),
+		rate:    rate,
+		burst:   burst,
+	}
+}
+
+func (d *RateLimitDelegate) bucketFor(buckets map[string]*tokenBucket, key string) *tokenBucket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, ok := buckets[key]
+	if !ok {
+		b = newTokenBucket(d.rate, d.burst)
+		buckets[key] = b
+	}
+	return b
+}
+
+// allowUser 为 key 对应的桶消费一个令牌；key 由 RateLimit 给出（用户名，或无用户名时去掉端口后的客户端 IP）
+func (d *RateLimitDelegate) allowUser(key string) bool {
+	return d.bucketFor(d.perUser, key).allow()
+}
+
+// AllowIP 为已选定的出口 IPv6 消费一个令牌；各路径在 pickOutgoingIP 生成/复用 IP 后经 allowOutgoingIP 调用
+func (d *RateLimitDelegate) AllowIP(ip string) bool {
+	return d.bucketFor(d.perIP, ip).allow()
+}
+
+// allowOutgoingIP 是 HTTP/CONNECT/SOCKS5 三条路径选定出口 IPv6 后的统一限流入口：
+// 未启用限流（rateLimitDelegate 为 nil）时始终放行。
+func allowOutgoingIP(ip string) bool {
+	if rateLimitDelegate == nil {
+		return true
+	}
+	return rateLimitDelegate.AllowIP(ip)
+}
+
+func (d *RateLimitDelegate) Connect(ctx *goproxy.ProxyCtx) {}
+
+func (d *RateLimitDelegate) Auth(ctx *goproxy.ProxyCtx) bool {
+	return true
+}
+
+// RateLimit 按认证用户名（未提供凭据时退化为去掉端口后的客户端 IP）消费一个令牌。
+// 退化键必须去掉端口——否则每条新连接的临时端口都不同，"per-user" 桶形同虚设，永远不会限流。
+func (d *RateLimitDelegate) RateLimit(ctx *goproxy.ProxyCtx) bool {
+	username := proxyAuthUsername(ctx.Req.Header.Get("Proxy-Authorization"))
+	key := username
+	if key == "" {
+		key = sessionKeyFromRemoteAddr(ctx.Req.RemoteAddr)
+	}
+	return d.allowUser(sessionBaseUsername(key))
+}
+
+func (d *RateLimitDelegate) BeforeRequest(ctx *goproxy.ProxyCtx) {}
+
+func (d *RateLimitDelegate) BeforeResponse(ctx *goproxy.ProxyCtx) {}
+
+func (d *RateLimitDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+func (d *RateLimitDelegate) Finish(ctx *goproxy.ProxyCtx) {}
+
+func (d *RateLimitDelegate) ErrorLog(err error) {}
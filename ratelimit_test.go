@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllowsUpToBurstThenBlocks(t *testing.T) {
+	b := newTokenBucket(0, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("request %d should be allowed within burst", i)
+		}
+	}
+	if b.allow() {
+		t.Fatalf("request beyond burst should be blocked when rate is 0")
+	}
+}
+
+func TestTokenBucketRefillsOverTime(t *testing.T) {
+	b := newTokenBucket(10, 1)
+	if !b.allow() {
+		t.Fatalf("first request should be allowed")
+	}
+	if b.allow() {
+		t.Fatalf("second immediate request should be blocked, bucket has no tokens left")
+	}
+
+	b.lastRefill = b.lastRefill.Add(-200 * time.Millisecond)
+	if !b.allow() {
+		t.Fatalf("request after refill window should be allowed")
+	}
+}
+
+func TestRateLimitDelegateAllowUserPerKey(t *testing.T) {
+	d := newRateLimitDelegate(0, 1)
+
+	if !d.allowUser("alice") {
+		t.Fatalf("alice's first request should be allowed")
+	}
+	if d.allowUser("alice") {
+		t.Fatalf("alice's second request should be blocked")
+	}
+	if !d.allowUser("bob") {
+		t.Fatalf("bob should have his own independent bucket")
+	}
+}
+
+func TestAllowOutgoingIPWithoutDelegate(t *testing.T) {
+	defer func(d *RateLimitDelegate) { rateLimitDelegate = d }(rateLimitDelegate)
+	rateLimitDelegate = nil
+
+	if !allowOutgoingIP("2001:db8::1") {
+		t.Fatalf("allowOutgoingIP should default to allow when rate limiting is disabled")
+	}
+}
+
+func TestAllowOutgoingIPWithDelegate(t *testing.T) {
+	defer func(d *RateLimitDelegate) { rateLimitDelegate = d }(rateLimitDelegate)
+	rateLimitDelegate = newRateLimitDelegate(0, 1)
+
+	if !allowOutgoingIP("2001:db8::1") {
+		t.Fatalf("first request for an IP should be allowed")
+	}
+	if allowOutgoingIP("2001:db8::1") {
+		t.Fatalf("second request for the same IP should be blocked")
+	}
+}
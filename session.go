@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// sessionEnabled 控制是否开启粘性会话（同一会话复用同一出口 IPv6），由 -sticky-session 参数设置
+var sessionEnabled bool
+
+// sessionTTL 是会话条目的存活时间，默认 10 分钟，由 -session-ttl 参数设置
+var sessionTTL = 10 * time.Minute
+
+// sessionMaxSize 是会话表允许的最大条目数，超出后淘汰最早过期的条目
+var sessionMaxSize = 10000
+
+// sessionEntry 记录一个会话键对应的出口 IPv6 及其过期时间
+type sessionEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// sessionStore 是一个由互斥锁保护的 LRU+TTL 会话表
+type sessionStore struct {
+	mu      sync.Mutex
+	entries map[string]sessionEntry
+	maxSize int
+	ttl     time.Duration
+}
+
+// sessions 是进程内的粘性会话表，由 registerSession 构造后才可用
+var sessions *sessionStore
+
+// registerSession 按 -session-ttl/-session-max-size 构造粘性会话表。其调用时机与
+// registerMITM/registerUpstream/registerDelegates 一致：由外层 main 在 flag.Parse
+// 之后调用——不能把 sessions 声明成在包初始化时就构造好的 var，否则 sessionTTL/
+// sessionMaxSize 读到的始终是命令行参数解析前的默认值。
+func registerSession() {
+	sessions = &sessionStore{
+		entries: make(map[string]sessionEntry),
+		maxSize: sessionMaxSize,
+		ttl:     sessionTTL,
+	}
+}
+
+// get 返回 key 对应的、尚未过期的 IP，命中时刷新其过期时间
+func (s *sessionStore) get(key string) (net.IP, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		if ok {
+			delete(s.entries, key)
+		}
+		return nil, false
+	}
+
+	entry.expires = time.Now().Add(s.ttl)
+	s.entries[key] = entry
+	return entry.ip, true
+}
+
+// set 写入（或覆盖）key 对应的 IP，必要时淘汰最早过期的条目腾出空间
+func (s *sessionStore) set(key string, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) >= s.maxSize {
+		s.evictOldestLocked()
+	}
+
+	s.entries[key] = sessionEntry{ip: ip, expires: time.Now().Add(s.ttl)}
+}
+
+// evictOldestLocked 删除过期时间最早的条目；调用方必须已持有锁
+func (s *sessionStore) evictOldestLocked() {
+	var oldestKey string
+	var oldestExpires time.Time
+	first := true
+
+	for k, v := range s.entries {
+		if first || v.expires.Before(oldestExpires) {
+			oldestKey = k
+			oldestExpires = v.expires
+			first = false
+		}
+	}
+
+	if !first {
+		delete(s.entries, oldestKey)
+	}
+}
+
+// sessionBaseUsername 在开启粘性会话时，去掉 "user-suffix" 形式用户名中的会话后缀，
+// 返回用于凭据校验的基础用户名；未开启粘性会话时原样返回，避免用户名本身含 "-"
+// （如 "api-user"）时被误截断导致鉴权失败。
+func sessionBaseUsername(username string) string {
+	if !sessionEnabled {
+		return username
+	}
+	if idx := strings.Index(username, "-"); idx != -1 {
+		return username[:idx]
+	}
+	return username
+}
+
+// sessionKeyFromUsername 从 "user-suffix" 形式的用户名解析出会话键 "user|suffix"，
+// 解析不出后缀时返回空字符串，调用方应回退到按客户端 IP 取键。
+func sessionKeyFromUsername(username string) string {
+	idx := strings.Index(username, "-")
+	if idx == -1 {
+		return ""
+	}
+	return username[:idx] + "|" + username[idx+1:]
+}
+
+// sessionKeyFromRemoteAddr 按客户端远程地址（去掉端口）构造会话键，作为兜底策略
+func sessionKeyFromRemoteAddr(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip|" + host
+}
+
+// sessionKeyFromRequest 解析请求的会话键：优先使用 Proxy-Authorization 中
+// "user-suffix:pass" 形式的 username 解析出 "user|suffix"；否则回退为客户端远程 IP。
+func sessionKeyFromRequest(req *http.Request, remoteAddr string) string {
+	if username := proxyAuthUsername(req.Header.Get("Proxy-Authorization")); username != "" {
+		if key := sessionKeyFromUsername(username); key != "" {
+			return key
+		}
+	}
+	return sessionKeyFromRemoteAddr(remoteAddr)
+}
+
+// proxyAuthUsername 从 Basic 认证头中解码出用户名部分（不含密码）
+func proxyAuthUsername(auth string) string {
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[0]
+}
+
+// pickOutgoingIPForKey 是 generateRandomIPv6(cidr) 的会话感知封装：当粘性会话开启时，
+// 优先复用 key 已分配的 IPv6，否则生成一个新的并记录下来，同时打印 session=/ip=/reused= 日志。
+func pickOutgoingIPForKey(key string) (string, error) {
+	if ip, ok := sessions.get(key); ok {
+		log.Printf("session=%s ip=%s reused=true", key, ip.String())
+		return ip.String(), nil
+	}
+
+	ipStr, err := generateRandomIPv6(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(ipStr); ip != nil {
+		sessions.set(key, ip)
+	}
+
+	log.Printf("session=%s ip=%s reused=false", key, ipStr)
+	return ipStr, nil
+}
+
+// pickOutgoingIP 是 HTTP/CONNECT 路径使用的出口 IPv6 选择器：粘性会话关闭时直接
+// 随机生成；开启时解析请求的会话键并委托给 pickOutgoingIPForKey。
+func pickOutgoingIP(ctx *goproxy.ProxyCtx, req *http.Request) (string, error) {
+	if !sessionEnabled {
+		return generateRandomIPv6(cidr)
+	}
+
+	remoteAddr := ""
+	if ctx != nil && ctx.Req != nil {
+		remoteAddr = ctx.Req.RemoteAddr
+	}
+	if remoteAddr == "" {
+		remoteAddr = req.RemoteAddr
+	}
+
+	return pickOutgoingIPForKey(sessionKeyFromRequest(req, remoteAddr))
+}
+
+// pickOutgoingIPSocks5 是 SOCKS5 路径使用的出口 IPv6 选择器：优先按认证阶段解析出的
+// username 后缀取键，username 为空或无后缀时回退到客户端远程地址。
+func pickOutgoingIPSocks5(username, remoteAddr string) (string, error) {
+	if !sessionEnabled {
+		return generateRandomIPv6(cidr)
+	}
+
+	key := ""
+	if username != "" {
+		key = sessionKeyFromUsername(username)
+	}
+	if key == "" {
+		key = sessionKeyFromRemoteAddr(remoteAddr)
+	}
+
+	return pickOutgoingIPForKey(key)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+)
+
+// basicAuthHeader 是测试专用的辅助函数，按 Basic 认证规则编码 "user:pass"
+func basicAuthHeader(user, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
+
+func TestSessionStoreGetSetRoundTrip(t *testing.T) {
+	s := &sessionStore{
+		entries: make(map[string]sessionEntry),
+		maxSize: 10,
+		ttl:     time.Minute,
+	}
+
+	if _, ok := s.get("missing"); ok {
+		t.Fatalf("get on empty store should miss")
+	}
+
+	ip := net.ParseIP("2001:db8::1")
+	s.set("user|a", ip)
+
+	got, ok := s.get("user|a")
+	if !ok || !got.Equal(ip) {
+		t.Fatalf("get(%q) = %v, %v; want %v, true", "user|a", got, ok, ip)
+	}
+}
+
+func TestSessionStoreExpiry(t *testing.T) {
+	s := &sessionStore{
+		entries: make(map[string]sessionEntry),
+		maxSize: 10,
+		ttl:     time.Minute,
+	}
+	s.entries["stale"] = sessionEntry{ip: net.ParseIP("::1"), expires: time.Now().Add(-time.Second)}
+
+	if _, ok := s.get("stale"); ok {
+		t.Fatalf("get should treat an already-expired entry as a miss")
+	}
+	if _, ok := s.entries["stale"]; ok {
+		t.Fatalf("get should evict the expired entry")
+	}
+}
+
+func TestSessionStoreEvictsOldestOnOverflow(t *testing.T) {
+	s := &sessionStore{
+		entries: make(map[string]sessionEntry),
+		maxSize: 2,
+		ttl:     time.Minute,
+	}
+	now := time.Now()
+	s.entries["oldest"] = sessionEntry{ip: net.ParseIP("::1"), expires: now.Add(time.Second)}
+	s.entries["newer"] = sessionEntry{ip: net.ParseIP("::2"), expires: now.Add(time.Hour)}
+
+	s.set("incoming", net.ParseIP("::3"))
+
+	if _, ok := s.entries["oldest"]; ok {
+		t.Fatalf("set should have evicted the entry with the earliest expiry")
+	}
+	if _, ok := s.entries["newer"]; !ok {
+		t.Fatalf("set should not evict entries other than the oldest")
+	}
+	if _, ok := s.entries["incoming"]; !ok {
+		t.Fatalf("set should have inserted the new entry")
+	}
+}
+
+func TestSessionBaseUsername(t *testing.T) {
+	defer func(enabled bool) { sessionEnabled = enabled }(sessionEnabled)
+
+	sessionEnabled = false
+	if got := sessionBaseUsername("api-user"); got != "api-user" {
+		t.Fatalf("sticky sessions disabled: got %q, want unchanged %q", got, "api-user")
+	}
+
+	sessionEnabled = true
+	if got := sessionBaseUsername("api-user"); got != "api" {
+		t.Fatalf("sticky sessions enabled: got %q, want %q", got, "api")
+	}
+	if got := sessionBaseUsername("noSuffix"); got != "noSuffix" {
+		t.Fatalf("username without '-': got %q, want unchanged %q", got, "noSuffix")
+	}
+}
+
+func TestSessionKeyFromUsername(t *testing.T) {
+	cases := []struct {
+		username string
+		want     string
+	}{
+		{"alice-tab1", "alice|tab1"},
+		{"noSuffix", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := sessionKeyFromUsername(c.username); got != c.want {
+			t.Errorf("sessionKeyFromUsername(%q) = %q, want %q", c.username, got, c.want)
+		}
+	}
+}
+
+func TestSessionKeyFromRemoteAddr(t *testing.T) {
+	cases := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.5:54321", "ip|203.0.113.5"},
+		{"no-port-here", "ip|no-port-here"},
+	}
+	for _, c := range cases {
+		if got := sessionKeyFromRemoteAddr(c.addr); got != c.want {
+			t.Errorf("sessionKeyFromRemoteAddr(%q) = %q, want %q", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestProxyAuthUsername(t *testing.T) {
+	cases := []struct {
+		name string
+		auth string
+		want string
+	}{
+		{"valid basic auth", "Basic " + basicAuthHeader("alice-tab1", "secret"), "alice-tab1"},
+		{"missing prefix", "Bearer abcdef", ""},
+		{"invalid base64", "Basic not-base64!!", ""},
+		{"no colon separator", "Basic " + base64.StdEncoding.EncodeToString([]byte("nocolonhere")), ""},
+	}
+	for _, c := range cases {
+		if got := proxyAuthUsername(c.auth); got != c.want {
+			t.Errorf("%s: proxyAuthUsername(%q) = %q, want %q", c.name, c.auth, got, c.want)
+		}
+	}
+}
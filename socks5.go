@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// socks5Enabled 控制是否启动 SOCKS5 监听，由 -socks5 命令行参数设置
+var socks5Enabled bool
+
+// socks5ListenAddr 是 SOCKS5 监听地址，由 -socks5-addr 命令行参数设置
+var socks5ListenAddr = ":1081"
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthUserPass = 0x02
+	socks5AuthNoAccept = 0xFF
+
+	socks5CmdConnect  = 0x01
+	socks5CmdUDPAssoc = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded            = 0x00
+	socks5ReplyCommandNotSupported  = 0x07
+	socks5ReplyGeneralFailure       = 0x01
+	socks5ReplyConnectionNotAllowed = 0x02
+)
+
+// startSocks5 启动 SOCKS5 监听，复用与 HTTP 代理相同的用户名/密码及随机 IPv6 拨号逻辑
+func startSocks5() {
+	if !socks5Enabled {
+		return
+	}
+
+	listener, err := net.Listen("tcp", socks5ListenAddr)
+	if err != nil {
+		log.Fatalf("[SOCKS5] 监听 %s 失败: %v", socks5ListenAddr, err)
+	}
+	log.Printf("[SOCKS5] 正在监听 %s", socks5ListenAddr)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("[SOCKS5] 接受连接失败: %v", err)
+				continue
+			}
+			go handleSocks5Conn(conn)
+		}
+	}()
+}
+
+func handleSocks5Conn(conn net.Conn) {
+	defer conn.Close()
+
+	username, err := socks5Handshake(conn)
+	if err != nil {
+		log.Printf("[SOCKS5] 握手失败: %v", err)
+		return
+	}
+
+	cmd, target, err := socks5ReadRequest(conn)
+	if err != nil {
+		log.Printf("[SOCKS5] 读取请求失败: %v", err)
+		return
+	}
+
+	if cmd == socks5CmdUDPAssoc {
+		socks5WriteReply(conn, socks5ReplyCommandNotSupported, "0.0.0.0:0")
+		return
+	}
+
+	if cmd != socks5CmdConnect {
+		socks5WriteReply(conn, socks5ReplyCommandNotSupported, "0.0.0.0:0")
+		return
+	}
+
+	outgoingIP, err := pickOutgoingIPSocks5(username, conn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("[SOCKS5] 生成随机 IPv6 失败: %v", err)
+		socks5WriteReply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+		return
+	}
+	if !allowOutgoingIP(outgoingIP) {
+		log.Printf("[SOCKS5] 出口 IPv6 %s 已触发限流", outgoingIP)
+		socks5WriteReply(conn, socks5ReplyConnectionNotAllowed, "0.0.0.0:0")
+		return
+	}
+
+	localAddr, err := net.ResolveTCPAddr("tcp", "["+outgoingIP+"]:0")
+	if err != nil {
+		log.Printf("[SOCKS5] 解析本地地址失败: %v", err)
+		socks5WriteReply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+		return
+	}
+	log.Printf("[SOCKS5请求] CONNECT %s (源 IPv6: %s)", target, outgoingIP)
+
+	server, err := dialWithOutgoingIP(localAddr, "tcp", target, nil)
+	if err != nil {
+		log.Printf("[SOCKS5] 拨号 %s 失败: %v", target, err)
+		socks5WriteReply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+		return
+	}
+	defer server.Close()
+
+	socks5WriteReply(conn, socks5ReplySucceeded, server.LocalAddr().String())
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(server, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, server)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// socks5Handshake 处理 SOCKS5 方法协商及 RFC 1929 用户名/密码认证，返回通过认证的用户名
+// （未要求认证时为空字符串），供会话粘性按 username 后缀取键使用。
+func socks5Handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	requireAuth := proxyUser != "" || proxyPassword != ""
+
+	wantMethod := byte(socks5AuthNone)
+	if requireAuth {
+		wantMethod = socks5AuthUserPass
+	}
+
+	supported := false
+	for _, m := range methods {
+		if m == wantMethod {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return "", fmt.Errorf("client does not support required auth method")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, wantMethod}); err != nil {
+		return "", err
+	}
+
+	if !requireAuth {
+		return "", nil
+	}
+
+	return socks5AuthenticateUserPass(conn)
+}
+
+// socks5AuthenticateUserPass 校验 RFC 1929 用户名/密码子协商，复用 basicAuth 使用的同一对凭据，
+// 认证成功时返回客户端提交的用户名。
+func socks5AuthenticateUserPass(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	ulen := int(header[1])
+	userBytes := make([]byte, ulen)
+	if _, err := io.ReadFull(conn, userBytes); err != nil {
+		return "", err
+	}
+
+	plenBuf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plenBuf); err != nil {
+		return "", err
+	}
+	plen := int(plenBuf[0])
+	passBytes := make([]byte, plen)
+	if _, err := io.ReadFull(conn, passBytes); err != nil {
+		return "", err
+	}
+
+	ok := sessionBaseUsername(string(userBytes)) == proxyUser && string(passBytes) == proxyPassword
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+	if _, err := conn.Write([]byte{0x01, status}); err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("invalid SOCKS5 username/password")
+	}
+	return string(userBytes), nil
+}
+
+// socks5ReadRequest 解析 SOCKS5 请求帧，返回命令类型及已解析的目标地址 "host:port"。
+// DOMAIN 类型的地址通过系统解析器解析，出站仍强制使用随机 IPv6 作为源地址。
+func socks5ReadRequest(conn net.Conn) (byte, string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks5Version {
+		return 0, "", fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	cmd := header[1]
+	addrType := header[3]
+
+	var host string
+	switch addrType {
+	case socks5AddrIPv4:
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return 0, "", err
+		}
+		host = net.IP(buf).String()
+	case socks5AddrIPv6:
+		buf := make([]byte, 16)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return 0, "", err
+		}
+		host = net.IP(buf).String()
+	case socks5AddrDomain:
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return 0, "", err
+		}
+		domain := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return 0, "", err
+		}
+		host = string(domain)
+	default:
+		return 0, "", fmt.Errorf("unsupported SOCKS5 address type: %d", addrType)
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return 0, "", err
+	}
+	port := binary.BigEndian.Uint16(portBuf)
+
+	return cmd, net.JoinHostPort(host, fmt.Sprintf("%d", port)), nil
+}
+
+// socks5WriteReply 向客户端写出标准 SOCKS5 应答帧，bindAddr 为已绑定的本地地址
+func socks5WriteReply(conn net.Conn, reply byte, bindAddr string) {
+	host, portStr, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		host, portStr = "0.0.0.0", "0"
+	}
+
+	ip := net.ParseIP(host)
+	addrType := byte(socks5AddrIPv4)
+	var ipBytes []byte
+	if ip == nil {
+		addrType = socks5AddrIPv4
+		ipBytes = []byte{0, 0, 0, 0}
+	} else if ip4 := ip.To4(); ip4 != nil {
+		addrType = socks5AddrIPv4
+		ipBytes = ip4
+	} else {
+		addrType = socks5AddrIPv6
+		ipBytes = ip.To16()
+	}
+
+	var port uint16
+	fmt.Sscanf(portStr, "%d", &port)
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, port)
+
+	resp := []byte{socks5Version, reply, 0x00, addrType}
+	resp = append(resp, ipBytes...)
+	resp = append(resp, portBytes...)
+	conn.Write(resp)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn backed by an in-memory reader/writer, used to
+// exercise socks5ReadRequest/socks5WriteReply without needing a real socket.
+type fakeConn struct {
+	r   io.Reader
+	out bytes.Buffer
+}
+
+func (c *fakeConn) Read(b []byte) (int, error)       { return c.r.Read(b) }
+func (c *fakeConn) Write(b []byte) (int, error)      { return c.out.Write(b) }
+func (c *fakeConn) Close() error                     { return nil }
+func (c *fakeConn) LocalAddr() net.Addr              { return nil }
+func (c *fakeConn) RemoteAddr() net.Addr             { return nil }
+func (c *fakeConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestSocks5ReadRequestDomain(t *testing.T) {
+	frame := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrDomain, byte(len("example.com"))}
+	frame = append(frame, []byte("example.com")...)
+	frame = append(frame, 0x01, 0xBB) // port 443
+
+	conn := &fakeConn{r: bytes.NewReader(frame)}
+	cmd, target, err := socks5ReadRequest(conn)
+	if err != nil {
+		t.Fatalf("socks5ReadRequest error: %v", err)
+	}
+	if cmd != socks5CmdConnect {
+		t.Errorf("cmd = %d, want %d", cmd, socks5CmdConnect)
+	}
+	if target != "example.com:443" {
+		t.Errorf("target = %q, want %q", target, "example.com:443")
+	}
+}
+
+func TestSocks5ReadRequestIPv4(t *testing.T) {
+	frame := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrIPv4, 127, 0, 0, 1, 0x00, 0x50}
+
+	conn := &fakeConn{r: bytes.NewReader(frame)}
+	_, target, err := socks5ReadRequest(conn)
+	if err != nil {
+		t.Fatalf("socks5ReadRequest error: %v", err)
+	}
+	if target != "127.0.0.1:80" {
+		t.Errorf("target = %q, want %q", target, "127.0.0.1:80")
+	}
+}
+
+func TestSocks5ReadRequestUnsupportedVersion(t *testing.T) {
+	frame := []byte{0x04, socks5CmdConnect, 0x00, socks5AddrIPv4, 127, 0, 0, 1, 0x00, 0x50}
+	conn := &fakeConn{r: bytes.NewReader(frame)}
+	if _, _, err := socks5ReadRequest(conn); err == nil {
+		t.Fatalf("expected error for unsupported SOCKS version")
+	}
+}
+
+func TestSocks5ReadRequestUnsupportedAddrType(t *testing.T) {
+	frame := []byte{socks5Version, socks5CmdConnect, 0x00, 0x7F}
+	conn := &fakeConn{r: bytes.NewReader(frame)}
+	if _, _, err := socks5ReadRequest(conn); err == nil {
+		t.Fatalf("expected error for unsupported address type")
+	}
+}
+
+func TestSocks5WriteReplyIPv4(t *testing.T) {
+	conn := &fakeConn{r: bytes.NewReader(nil)}
+	socks5WriteReply(conn, socks5ReplySucceeded, "192.0.2.1:1080")
+
+	want := []byte{socks5Version, socks5ReplySucceeded, 0x00, socks5AddrIPv4, 192, 0, 2, 1, 0x04, 0x38}
+	if !bytes.Equal(conn.out.Bytes(), want) {
+		t.Errorf("reply = % x, want % x", conn.out.Bytes(), want)
+	}
+}
+
+func TestSocks5WriteReplyFallsBackOnInvalidAddr(t *testing.T) {
+	conn := &fakeConn{r: bytes.NewReader(nil)}
+	socks5WriteReply(conn, socks5ReplyGeneralFailure, "not-an-addr")
+
+	want := []byte{socks5Version, socks5ReplyGeneralFailure, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0x00, 0x00}
+	if !bytes.Equal(conn.out.Bytes(), want) {
+		t.Errorf("reply = % x, want % x", conn.out.Bytes(), want)
+	}
+}